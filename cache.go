@@ -25,12 +25,21 @@
 // we can tend to minimize the number of lines read on average.
 // Again, we'll ensure that the cache is 100% used by adding entries.
 // Note we assume the file contents never change, and that it is
-// newline-terminated text.
+// terminated by a configurable record separator (a plain newline by
+// default) which may itself be more than one byte, e.g. "\r\n" or a
+// UTF-16 line-ending sequence.
 //
 // One reason we do not ever change the cache is that the problem
 // statement does not hint at any kind of locality or repitition
 // of references.  So if we cached new uncached line numbers, we'd
 // end up destroying the uniform spacing.
+//
+// Lookup itself is backed by a persistent memory-mapped view of the
+// target file rather than the open/seek/read-per-request dance this
+// package used to do; see lookupMmap below.  On platforms or files
+// where mmap is unavailable, we fall back to a pooled bufio.Reader
+// path (lookupFallback) so the cache still works, just without the
+// zero-copy scan.
 package main
 
 import (
@@ -42,13 +51,63 @@ import (
 	"math/rand"
 	"os"
 	"sort"
+	"sync"
+)
+
+const (
+	// Size of the bufio.Reader buffer used by the fallback (non-mmap)
+	// lookup path.
+	fallbackBufSize = 4096
+
+	// Upper bound on concurrent fallback scans.  This is the
+	// semaphore-style limiter that keeps a flood of concurrent GETs
+	// against a giant file from ballooning memory via the reader
+	// pool; once the limit is hit, further lookups simply wait their
+	// turn.
+	maxConcurrentScans = 256
 )
 
+// defaultRecordSep is the record separator used when the caller does
+// not specify one: a plain newline.  It is a var, not a const, since
+// recordSep is a byte sequence rather than a single byte -- see the
+// lineOffsetCache.recordSep field comment.
+var defaultRecordSep = []byte{'\n'}
+
+// readerPool recycles the bufio.Readers used by lookupFallback so a
+// fresh one is not allocated on every request.
+var readerPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, fallbackBufSize)
+	},
+}
+
+// scanSem bounds how many fallback scans may run concurrently.
+var scanSem = make(chan struct{}, maxConcurrentScans)
+
 // IndexCache is an interface that defines the methods for any line
 // server cache.  Thus we are not licked to this particular implmentation.
 // Normally this interface declaration would go in a different file/package.
 type IndexCache interface {
 	Lookup(lineno int64) (string, error)
+
+	// LookupRange returns the count lines starting at start (both
+	// 1-based and inclusive of start), sharing a single scan across
+	// the whole range rather than the cost of count independent
+	// Lookup calls.
+	LookupRange(start, count int64) ([]string, error)
+
+	// Count returns the total number of lines in the indexed file.
+	Count() int64
+
+	// Size returns the number of entries held in the cache itself
+	// (as opposed to the file it indexes).
+	Size() int
+
+	// HitRate returns the fraction of Lookup calls satisfied without
+	// reading the underlying file, for reporting via STATS.  The
+	// static offset cache always reads the file, so it reports 0;
+	// decorators such as hotCache override this.
+	HitRate() float64
 }
 
 // Per-line data.
@@ -59,10 +118,58 @@ type lineInfo struct {
 
 // The static cache object.  Note for the sake of concurrency, we
 // store the filename, not the os.File object.
+//
+// If data is non-nil, it is a persistent memory-mapped view of the
+// file backed by mmFile, and Lookup scans it directly.  If mmap could
+// not be established (unsupported platform, empty file, permission
+// error, etc.), data and mmFile are left nil and Lookup falls back to
+// opening the file per-request.
 type lineOffsetCache struct {
 	filename string
 	cache    []lineInfo
 	totLines int64
+
+	// recordSep is the byte sequence terminating each record. It is a
+	// slice rather than a single byte so that multi-byte separators
+	// such as "\r\n", or a UTF-16 line-ending sequence passed as its
+	// raw encoded bytes, are supported alongside the common
+	// single-byte case.
+	recordSep []byte
+
+	data   []byte
+	mmFile *os.File
+}
+
+// sepMatcher tracks, one fed byte at a time, how much of a trailing
+// run matches a (possibly multi-byte) record separator. It lets the
+// byte-at-a-time scanners below (getLineCount, processLines,
+// lookupRangeFallback) detect a multi-byte separator without
+// buffering whole records just to compare them.
+type sepMatcher struct {
+	sep []byte
+	n   int // length of the trailing match so far
+}
+
+func newSepMatcher(sep []byte) *sepMatcher {
+	return &sepMatcher{sep: sep}
+}
+
+// feed records one more scanned byte and reports whether it just
+// completed the separator.
+func (m *sepMatcher) feed(b byte) bool {
+	if b == m.sep[m.n] {
+		m.n++
+		if m.n == len(m.sep) {
+			m.n = 0
+			return true
+		}
+		return false
+	}
+	if m.n == 0 {
+		return false
+	}
+	m.n = 0
+	return m.feed(b)
 }
 
 // Int64Slice is neeed because no built in sort of int64 slices in Go :-(
@@ -77,11 +184,19 @@ var (
 	_ IndexCache = (*lineOffsetCache)(nil)
 )
 
-// NewLineOffsetCache creates a new cache object given a file name and
-// target cache size.  Returns an error if something went wrong.  The
-// design-specifics and algorith are documented in the header comment.
-func newLineOffsetCache(filename string, cacheSize int) (
+// NewLineOffsetCache creates a new cache object given a file name,
+// target cache size, and record separator (NUL is a valid separator
+// byte in its own right, so there is no sentinel for "use the
+// default" here -- callers wanting the default newline should pass
+// defaultRecordSep explicitly).  recordSep must be non-empty; it may
+// be more than one byte, e.g. []byte("\r\n"). Returns an error if
+// something went wrong.  The design-specifics and algorith are
+// documented in the header comment.
+func newLineOffsetCache(filename string, cacheSize int, recordSep []byte) (
 	*lineOffsetCache, error) {
+	if len(recordSep) == 0 {
+		return nil, fmt.Errorf("record separator must not be empty")
+	}
 	f, err := os.OpenFile(filename, os.O_RDWR, 0)
 	if err != nil {
 		log.Printf("error opening target file: '%v'\n", err)
@@ -94,7 +209,7 @@ func newLineOffsetCache(filename string, cacheSize int) (
 	}()
 
 	// We need the line count to determine the spacing.
-	cnt, err := getLineCount(f)
+	cnt, err := getLineCount(f, recordSep)
 	if err != nil {
 		log.Printf("error getting line count: '%v'\n", err)
 		return nil, err
@@ -106,47 +221,122 @@ func newLineOffsetCache(filename string, cacheSize int) (
 		log.Printf("seek error: '%v'\n", err)
 		return nil, err
 	}
-	cache, err := buildCache(f, cnt, cacheSize)
+	cache, err := buildCache(f, cnt, cacheSize, recordSep)
 	if err != nil {
 		log.Printf("read error building cache: '%v'\n", err)
 		return nil, err
 	}
-	return &lineOffsetCache{cache: cache, filename: filename, totLines: cnt},
-		nil
+
+	loc := &lineOffsetCache{
+		cache:     cache,
+		filename:  filename,
+		totLines:  cnt,
+		recordSep: recordSep,
+	}
+
+	// Try to establish a persistent mmap for the fast Lookup path.
+	// Failure here is not fatal: we simply fall back to the buffered
+	// per-request read path used before this cache gained mmap
+	// support.
+	if mf, err := os.Open(filename); err != nil {
+		log.Printf(
+			"warning: unable to reopen '%s' for mmap, using buffered reads: %v\n",
+			filename, err)
+	} else if data, err := mmapFile(mf); err != nil {
+		log.Printf(
+			"warning: mmap unavailable for '%s', using buffered reads: %v\n",
+			filename, err)
+		if cerr := mf.Close(); cerr != nil {
+			log.Printf("warning: unable to close '%s': %v\n", filename, cerr)
+		}
+	} else if data != nil {
+		loc.data = data
+		loc.mmFile = mf
+	} else {
+		// Empty file; nothing useful to map.
+		if cerr := mf.Close(); cerr != nil {
+			log.Printf("warning: unable to close '%s': %v\n", filename, cerr)
+		}
+	}
+	return loc, nil
+}
+
+// Close releases resources held by the cache, namely the persistent
+// mmap established in newLineOffsetCache (if any).  Safe to call even
+// when mmap was never established.
+func (loc *lineOffsetCache) Close() error {
+	if loc.data == nil {
+		return nil
+	}
+	if err := munmapFile(loc.data); err != nil {
+		return err
+	}
+	loc.data = nil
+	mf := loc.mmFile
+	loc.mmFile = nil
+	if mf != nil {
+		return mf.Close()
+	}
+	return nil
+}
+
+// Count returns the total number of lines in the indexed file.
+func (loc *lineOffsetCache) Count() int64 {
+	return loc.totLines
+}
+
+// Size returns the number of entries held in the offset cache.
+func (loc *lineOffsetCache) Size() int {
+	return len(loc.cache)
+}
+
+// HitRate is always 0: the static offset cache is the authoritative
+// miss path and reads the file on every Lookup.
+func (loc *lineOffsetCache) HitRate() float64 {
+	return 0
 }
 
 // Lookup a string given the line number.  Note we used a 0-based
 // line cache, but the user interface is 1-based, so we adjust.
-// Note the trailing newline is left intact.
+// Note the trailing record separator is left intact.
 func (loc *lineOffsetCache) Lookup(lineno int64) (string, error) {
-	lineno--
-	if lineno < 0 || lineno >= loc.totLines {
-		return "", fmt.Errorf(
-			"invalid requested line number '%d': %d lines in file",
-			lineno+1, loc.totLines)
+	lines, err := loc.LookupRange(lineno, 1)
+	if err != nil {
+		return "", err
 	}
+	return lines[0], nil
+}
 
-	li := findLineInfo(lineno, loc.cache)
-	if li != nil && li.lineno > lineno {
-		// Should not happen.
-		return "",
-			fmt.Errorf("unexpected search error for line number '%d'", lineno)
+// LookupRange returns the count lines starting at start (1-based,
+// inclusive), sharing a single forward scan across the whole range.
+// It is the building block both for Lookup (count == 1) and for the
+// server's per-connection read-ahead window.
+func (loc *lineOffsetCache) LookupRange(start, count int64) (
+	[]string, error) {
+	if count <= 0 {
+		return nil, nil
 	}
 
-	f, err := os.OpenFile(loc.filename, os.O_RDWR, 0)
-	if err != nil {
-		log.Printf("error opening target file: '%v'\n", err)
-		return "", err
+	first := start - 1
+	last := first + count - 1
+	if first < 0 || first >= loc.totLines {
+		return nil, fmt.Errorf(
+			"invalid requested line number '%d': %d lines in file",
+			start, loc.totLines)
+	}
+	if last >= loc.totLines {
+		last = loc.totLines - 1
+	}
+
+	li := findLineInfo(first, loc.cache)
+	if li != nil && li.lineno > first {
+		// Should not happen.
+		return nil,
+			fmt.Errorf("unexpected search error for line number '%d'", start)
 	}
-	defer func() {
-		if err := f.Close(); err != nil {
-			log.Printf("warning: unable to close search file: %v\n", err)
-		}
-	}()
 
 	var begin int64
 	var seekTo int64
-	var res string
 	if li == nil {
 		// No such animal in the cache, so our line number is below the min.
 		begin = 0
@@ -157,23 +347,108 @@ func (loc *lineOffsetCache) Lookup(lineno int64) (string, error) {
 		seekTo = li.offset
 	}
 
-	_, err = f.Seek(seekTo, 0)
+	if loc.data != nil {
+		return loc.lookupRangeMmap(begin, seekTo, first, last)
+	}
+	return loc.lookupRangeFallback(begin, seekTo, first, last)
+}
+
+// lookupRangeMmap scans forward from seekTo (the byte offset of line
+// number begin) over the cache's memory-mapped view of the file,
+// counting separators until it reaches first, then collects lines up
+// through last.  This is just a bounds check plus a bytes.Index loop
+// over the shared mapping: no file descriptor, seek, or per-request
+// allocation is involved beyond the returned strings.
+func (loc *lineOffsetCache) lookupRangeMmap(begin, seekTo, first, last int64) (
+	[]string, error) {
+	data := loc.data
+	sep := loc.recordSep
+	if seekTo > int64(len(data)) {
+		return nil, fmt.Errorf("seek offset %d beyond mapped file size %d",
+			seekTo, len(data))
+	}
+
+	pos := seekTo
+	for ndx := begin; ndx < first; ndx++ {
+		rel := bytes.Index(data[pos:], sep)
+		if rel < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		pos += int64(rel) + int64(len(sep))
+	}
+
+	res := make([]string, 0, last-first+1)
+	for ndx := first; ndx <= last; ndx++ {
+		rel := bytes.Index(data[pos:], sep)
+		if rel < 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		res = append(res, string(data[pos:pos+int64(rel)+int64(len(sep))]))
+		pos += int64(rel) + int64(len(sep))
+	}
+	return res, nil
+}
+
+// lookupRangeFallback is the buffered read path used when the cache
+// was unable to mmap the target file.  It mirrors the cache's
+// original open/seek/read behavior, but draws its bufio.Reader from
+// readerPool instead of allocating a fresh one per request, and
+// bounds the number of concurrent scans via scanSem.
+func (loc *lineOffsetCache) lookupRangeFallback(begin, seekTo, first,
+	last int64) ([]string, error) {
+	scanSem <- struct{}{}
+	defer func() { <-scanSem }()
+
+	f, err := os.OpenFile(loc.filename, os.O_RDONLY, 0)
 	if err != nil {
-		return "", err
+		log.Printf("error opening target file: '%v'\n", err)
+		return nil, err
 	}
-	r := bufio.NewReader(f)
-	for ndx := begin; ndx <= lineno; ndx++ {
-		b, err := r.ReadBytes('\n')
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Printf("warning: unable to close search file: %v\n", err)
+		}
+	}()
+
+	if _, err := f.Seek(seekTo, 0); err != nil {
+		return nil, err
+	}
+
+	r := readerPool.Get().(*bufio.Reader)
+	r.Reset(f)
+	defer readerPool.Put(r)
+
+	m := newSepMatcher(loc.recordSep)
+	res := make([]string, 0, last-first+1)
+	for ndx := begin; ndx <= last; ndx++ {
+		b, err := readRecord(r, m)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if ndx == lineno {
-			res = string(b)
+		if ndx >= first {
+			res = append(res, string(b))
 		}
 	}
 	return res, nil
 }
 
+// readRecord reads from r up through (and including) the next
+// occurrence of m's separator, generalizing bufio.Reader.ReadBytes to
+// a possibly multi-byte delimiter.
+func readRecord(r *bufio.Reader, m *sepMatcher) ([]byte, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		if m.feed(b) {
+			return buf, nil
+		}
+	}
+}
+
 // Finds the line info for the entry that has the largest line number
 // less than or equal to the desired line number. using a binary search.
 // Note: this version of the code is the result of manually unrolling
@@ -203,15 +478,27 @@ func findLineInfo(linenum int64, li []lineInfo) *lineInfo {
 	}
 }
 
-// Count the number of lines in the file in an optimized manner.
-func getLineCount(f *os.File) (int64, error) {
+// Count the number of lines in the file in an optimized manner.  For
+// the common single-byte separator, this counts occurrences across
+// bulk-read buffers (bytes.Count is a tight loop and a separator
+// can't be split across a buffer boundary since it's only one byte).
+// A multi-byte separator can straddle a buffer boundary, so that case
+// falls back to a byte-at-a-time scan via sepMatcher instead.
+func getLineCount(f *os.File, recordSep []byte) (int64, error) {
+	if len(recordSep) == 1 {
+		return getLineCountSingleByte(f, recordSep[0])
+	}
+	return getLineCountMultiByte(f, recordSep)
+}
+
+// Modified slightly from: https://stackoverflow.com/questions/24562942/
+// golang-how-do-i-determine-the-number-of-lines-in-a-file-efficiently
+func getLineCountSingleByte(f *os.File, recordSep byte) (int64, error) {
 	r := bufio.NewReader(f)
 
-	// Modified slightly from: https://stackoverflow.com/questions/24562942/
-	// golang-how-do-i-determine-the-number-of-lines-in-a-file-efficiently
 	buf := make([]byte, 32*1024)
 	count := int64(0)
-	lineSep := []byte{'\n'}
+	lineSep := []byte{recordSep}
 
 	for {
 		c, err := r.Read(buf)
@@ -227,17 +514,37 @@ func getLineCount(f *os.File) (int64, error) {
 	}
 }
 
+func getLineCountMultiByte(f *os.File, recordSep []byte) (int64, error) {
+	r := bufio.NewReader(f)
+	m := newSepMatcher(recordSep)
+	count := int64(0)
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+		if m.feed(b) {
+			count++
+		}
+	}
+}
+
 // Build the cache given the total number of lines and target
 // cache size.
-func buildCache(f *os.File, lineCnt int64,
-	cacheLen int) ([]lineInfo, error) {
+func buildCache(f *os.File, lineCnt int64, cacheLen int,
+	recordSep []byte) ([]lineInfo, error) {
 	// Given the line count and requested buffer length, determine
 	// how many lines to actually store, attempting to maintain
 	// uniform spacing.
 	if lineCnt < int64(cacheLen) {
 		// Cache is larger than the number of lines in the file, so
 		// index every line.
-		return processLines(f, make([]lineInfo, lineCnt), lineCnt, 1)
+		return processLines(f, make([]lineInfo, lineCnt), lineCnt, 1,
+			recordSep)
 	}
 
 	// Cache is smaller than line count, so include equally spaced
@@ -247,13 +554,13 @@ func buildCache(f *os.File, lineCnt int64,
 	if lineCnt%int64(cacheLen) != 0 {
 		skipFactor++
 	}
-	return processLines(f, li, lineCnt, skipFactor)
+	return processLines(f, li, lineCnt, skipFactor, recordSep)
 }
 
 // Populate the cache with every one of every "skip_factor"
 // lines read.
-func processLines(f *os.File, li []lineInfo, numLines, skipFactor int64) (
-	[]lineInfo, error) {
+func processLines(f *os.File, li []lineInfo, numLines, skipFactor int64,
+	recordSep []byte) ([]lineInfo, error) {
 
 	// To ensure the cache is fully utilized, randomly pick some line
 	// numbers in the file that would not have been cached and add them
@@ -279,11 +586,13 @@ func processLines(f *os.File, li []lineInfo, numLines, skipFactor int64) (
 
 	// One goal in this loop is to avoid unnecessary slice creation,
 	// so we'll read single buffered bytes instead of depending on
-	// ReadBytes(delim byte).
+	// ReadBytes(delim byte). sepMatcher lets this still detect a
+	// multi-byte separator one byte at a time.
 	saveOff := int64(0)
 	offset := int64(0)
 	nextSlot := int64(0)
 	r := bufio.NewReader(f)
+	m := newSepMatcher(recordSep)
 	for line := int64(0); line < numLines; {
 		b, err := r.ReadByte()
 		if err != nil {
@@ -293,7 +602,7 @@ func processLines(f *os.File, li []lineInfo, numLines, skipFactor int64) (
 				return nil, err
 			}
 		}
-		if b == '\n' {
+		if m.feed(b) {
 			// Note: extras will not contain any mod skipFactor == 0 values
 			useExtra := len(extras) > 0 && extras[0] == line
 			if line%skipFactor == 0 || useExtra {
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// mmapFile is not implemented on this platform; callers fall back to
+// the buffered read path.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, fmt.Errorf("mmap not supported on this platform")
+}
+
+// munmapFile is a no-op on this platform.
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the entire contents of f into memory for read-only
+// access.  The returned slice is backed by the mapping and remains
+// valid until munmapFile is called on it; f may be closed immediately
+// afterwards since the mapping does not depend on the descriptor
+// staying open.
+func mmapFile(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		// Nothing to map; treat as mmap-unavailable so callers fall
+		// back to the buffered path rather than dealing with a
+		// zero-length mapping.
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ,
+		syscall.MAP_SHARED)
+}
+
+// munmapFile releases a mapping previously returned by mmapFile.
+func munmapFile(data []byte) error {
+	if data == nil {
+		return nil
+	}
+	return syscall.Munmap(data)
+}
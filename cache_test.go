@@ -38,6 +38,80 @@ func TestCache(t *testing.T) {
 		65536, 1024*1024+389)
 }
 
+// TestCacheMultiByteSeparator exercises indexing and lookup with a
+// record separator longer than one byte, e.g. "\r\n", to guard
+// against the separator being split across a buffer or scan boundary.
+func TestCacheMultiByteSeparator(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "cache_test")
+	if err != nil {
+		t.Fatalf("temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cp := path.Join(tmpdir, "testfile.txt")
+	doTestCacheFileSep(t, cp, []byte("\r\n"), 40, 199, 0, 13, 198, 199, 200, 201)
+	doTestCacheFileSep(t, cp, []byte("\r\n"), 1024, 10000, 1, 5000, 10000)
+	doTestCacheFileSep(t, cp, []byte("||"), 40, 300, 1, 150, 300)
+}
+
+func doTestCacheFileSep(t *testing.T, filename string, recordSep []byte,
+	cacheSize int, lineCnt int64, targetLine ...int64) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	closed := false
+	defer os.Remove(filename)
+	defer func() {
+		if !closed {
+			f.Close()
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	for i := int64(0); i < lineCnt; i++ {
+		_, err := w.Write([]byte(fmt.Sprintf("Here is line %d.", i+1)))
+		if err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+		if _, err := w.Write(recordSep); err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+	}
+	w.Flush()
+	if err = f.Close(); err != nil {
+		t.Fatalf("close temp file: %v", err)
+	}
+	closed = true
+
+	c, err := newLineOffsetCache(filename, cacheSize, recordSep)
+	if err != nil {
+		t.Fatalf("create cache: %v", err)
+	}
+
+	if c.Count() != lineCnt {
+		t.Fatalf("expected %d lines, got %d", lineCnt, c.Count())
+	}
+
+	for _, v := range targetLine {
+		l, err := c.Lookup(v)
+		if v <= 0 || v > lineCnt {
+			if err == nil {
+				t.Fatalf("no error for lookup invalid line: %d\n", v)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("lookup line %d: %v", v, err)
+		}
+
+		want := fmt.Sprintf("Here is line %d.%s", v, recordSep)
+		if l != want {
+			t.Fatalf("lookup line unexpected result for line %d: got %q, want %q\n",
+				v, l, want)
+		}
+	}
+}
+
 func doTestCacheFile(t *testing.T, filename string, cacheSize int,
 	lineCnt int64, targetLine ...int64) {
 	f, err := os.Create(filename)
@@ -65,7 +139,7 @@ func doTestCacheFile(t *testing.T, filename string, cacheSize int,
 	}
 	closed = true
 
-	c, err := newLineOffsetCache(filename, cacheSize)
+	c, err := newLineOffsetCache(filename, cacheSize, defaultRecordSep)
 	if err != nil {
 		t.Fatalf("create cache: %v", err)
 	}
@@ -0,0 +1,213 @@
+// hotCache is a second, dynamic cache tier layered in front of the
+// static lineOffsetCache.  cache.go explicitly rejects this kind of
+// caching for the static tier ("the problem statement does not hint
+// at any kind of locality"), and that reasoning still holds for the
+// offset cache itself -- but real deployments (log tailing, repeated
+// debugger queries) do exhibit locality on the lines actually
+// returned to clients, which is what this tier is for.
+//
+// It is a sharded LRU keyed by line number with a byte budget rather
+// than an entry-count budget, since line lengths vary widely.
+// Sharding (and a per-shard mutex, rather than one lock for the whole
+// cache) keeps concurrent GETs for different lines from serializing
+// on a single lock.
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// hotCacheShardCount is the number of independent LRU shards. Lines
+// are distributed across shards by lineno, so unrelated GETs rarely
+// contend on the same shard's mutex.
+const hotCacheShardCount = 16
+
+type hotCacheEntry struct {
+	lineno int64
+	value  string
+}
+
+// hotCacheShard is one bucket of the sharded LRU: a doubly linked
+// list (front == most recently used) plus an index into it, evicted
+// from the back once byteUsed exceeds byteLimit.
+type hotCacheShard struct {
+	mu        sync.Mutex
+	ll        *list.List
+	items     map[int64]*list.Element
+	byteUsed  int64
+	byteLimit int64
+}
+
+// hotCache wraps an IndexCache, serving Lookups out of its sharded
+// LRU when possible and otherwise falling through to the wrapped
+// cache, which remains the authoritative miss path.
+type hotCache struct {
+	inner  IndexCache
+	shards [hotCacheShardCount]*hotCacheShard
+
+	hits   int64
+	misses int64
+}
+
+var (
+	// Ensure type conforms to interface.
+	_ IndexCache = (*hotCache)(nil)
+)
+
+// newHotCache wraps inner with a sharded LRU bounded by byteBudget
+// bytes total, split evenly across hotCacheShardCount shards.
+func newHotCache(inner IndexCache, byteBudget int64) *hotCache {
+	perShard := byteBudget / hotCacheShardCount
+	if perShard < 1 {
+		perShard = 1
+	}
+	hc := &hotCache{inner: inner}
+	for i := range hc.shards {
+		hc.shards[i] = &hotCacheShard{
+			ll:        list.New(),
+			items:     make(map[int64]*list.Element),
+			byteLimit: perShard,
+		}
+	}
+	return hc
+}
+
+func (hc *hotCache) shardFor(lineno int64) *hotCacheShard {
+	return hc.shards[uint64(lineno)%hotCacheShardCount]
+}
+
+// Lookup serves lineno from the hot cache if present, otherwise
+// delegates to the wrapped cache and populates the hot cache with the
+// result.
+func (hc *hotCache) Lookup(lineno int64) (string, error) {
+	if v, ok := hc.get(lineno); ok {
+		atomic.AddInt64(&hc.hits, 1)
+		return v, nil
+	}
+	atomic.AddInt64(&hc.misses, 1)
+
+	v, err := hc.inner.Lookup(lineno)
+	if err != nil {
+		return "", err
+	}
+	hc.put(lineno, v)
+	return v, nil
+}
+
+// LookupRange serves whichever of the count lines starting at start
+// are already present in the hot cache, and delegates only the
+// missing ones to the wrapped cache in as few scans as possible by
+// grouping contiguous runs of misses into a single LookupRange call.
+// Lines fetched this way are then populated into the hot cache so
+// later Lookups/LookupRanges covering them can hit.
+//
+// Like lineOffsetCache.LookupRange, the result is clipped to however
+// many lines actually exist past start rather than padded out to
+// count: a hit can only ever exist for a line number some earlier,
+// successful lookup already validated, so the first miss run that
+// comes back short from inner marks the first line past EOF, and
+// nothing from there on (hit or miss) is trustworthy.
+func (hc *hotCache) LookupRange(start, count int64) ([]string, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	res := make([]string, count)
+	have := make([]bool, count)
+	for i := int64(0); i < count; i++ {
+		if v, ok := hc.get(start + i); ok {
+			atomic.AddInt64(&hc.hits, 1)
+			res[i] = v
+			have[i] = true
+		} else {
+			atomic.AddInt64(&hc.misses, 1)
+		}
+	}
+
+	// Fill in the gaps left by misses, one contiguous run at a time,
+	// so an all-miss range still costs a single inner scan rather
+	// than count independent ones.
+	valid := count
+	for i := int64(0); i < count; {
+		if have[i] {
+			i++
+			continue
+		}
+		j := i
+		for j < count && !have[j] {
+			j++
+		}
+		lines, err := hc.inner.LookupRange(start+i, j-i)
+		if err != nil {
+			return nil, err
+		}
+		for k, l := range lines {
+			res[i+int64(k)] = l
+			hc.put(start+i+int64(k), l)
+		}
+		if int64(len(lines)) < j-i {
+			valid = i + int64(len(lines))
+			break
+		}
+		i = j
+	}
+	return res[:valid], nil
+}
+
+func (hc *hotCache) Count() int64 { return hc.inner.Count() }
+func (hc *hotCache) Size() int    { return hc.inner.Size() }
+
+// HitRate returns the fraction of Lookup calls satisfied from the hot
+// cache, for reporting via STATS.
+func (hc *hotCache) HitRate() float64 {
+	hits := atomic.LoadInt64(&hc.hits)
+	misses := atomic.LoadInt64(&hc.misses)
+	total := hits + misses
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+func (hc *hotCache) get(lineno int64) (string, bool) {
+	s := hc.shardFor(lineno)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[lineno]
+	if !ok {
+		return "", false
+	}
+	s.ll.MoveToFront(el)
+	return el.Value.(*hotCacheEntry).value, true
+}
+
+func (hc *hotCache) put(lineno int64, value string) {
+	s := hc.shardFor(lineno)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[lineno]; ok {
+		entry := el.Value.(*hotCacheEntry)
+		s.byteUsed += int64(len(value)) - int64(len(entry.value))
+		entry.value = value
+		s.ll.MoveToFront(el)
+	} else {
+		entry := &hotCacheEntry{lineno: lineno, value: value}
+		s.items[lineno] = s.ll.PushFront(entry)
+		s.byteUsed += int64(len(value))
+	}
+
+	for s.byteUsed > s.byteLimit {
+		back := s.ll.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*hotCacheEntry)
+		s.ll.Remove(back)
+		delete(s.items, entry.lineno)
+		s.byteUsed -= int64(len(entry.value))
+	}
+}
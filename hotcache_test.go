@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeCache is a trivial in-memory IndexCache used to isolate hotCache
+// behavior from the real file-backed lineOffsetCache, and to count how
+// many times (and for which lines) the wrapped cache was actually
+// consulted.
+type fakeCache struct {
+	lines        []string
+	lookupCalls  int
+	rangeCalls   int
+	rangeReqSize []int64
+}
+
+func (f *fakeCache) Lookup(lineno int64) (string, error) {
+	f.lookupCalls++
+	lines, err := f.LookupRange(lineno, 1)
+	if err != nil {
+		return "", err
+	}
+	return lines[0], nil
+}
+
+func (f *fakeCache) LookupRange(start, count int64) ([]string, error) {
+	f.rangeCalls++
+	f.rangeReqSize = append(f.rangeReqSize, count)
+	first := start - 1
+	if first < 0 || first >= int64(len(f.lines)) {
+		return nil, fmt.Errorf("invalid line number '%d'", start)
+	}
+	last := first + count
+	if last > int64(len(f.lines)) {
+		last = int64(len(f.lines))
+	}
+	res := make([]string, 0, last-first)
+	for i := first; i < last; i++ {
+		res = append(res, f.lines[i])
+	}
+	return res, nil
+}
+
+func (f *fakeCache) Count() int64     { return int64(len(f.lines)) }
+func (f *fakeCache) Size() int        { return len(f.lines) }
+func (f *fakeCache) HitRate() float64 { return 0 }
+
+func newFakeCache(n int) *fakeCache {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i+1)
+	}
+	return &fakeCache{lines: lines}
+}
+
+// TestHotCacheLookupRangeServesFromShards verifies that once a line
+// has been populated into the hot cache (via Lookup or LookupRange),
+// a subsequent LookupRange covering it is served from the hot cache
+// instead of re-consulting the wrapped cache.
+func TestHotCacheLookupRangeServesFromShards(t *testing.T) {
+	inner := newFakeCache(100)
+	hc := newHotCache(inner, 1024*1024)
+
+	if _, err := hc.Lookup(5); err != nil {
+		t.Fatalf("Lookup(5): %v", err)
+	}
+	callsBefore := inner.rangeCalls
+
+	lines, err := hc.LookupRange(5, 1)
+	if err != nil {
+		t.Fatalf("LookupRange(5, 1): %v", err)
+	}
+	if lines[0] != "line 5\n" {
+		t.Fatalf("unexpected line: %q", lines[0])
+	}
+	if inner.rangeCalls != callsBefore {
+		t.Fatalf("expected LookupRange to be served from the hot cache "+
+			"without consulting inner, but inner.rangeCalls went from %d to %d",
+			callsBefore, inner.rangeCalls)
+	}
+
+	if rate := hc.HitRate(); rate <= 0 {
+		t.Fatalf("expected a nonzero hot cache hit rate, got %v", rate)
+	}
+}
+
+// TestHotCacheLookupRangePartialHit verifies that a LookupRange
+// spanning both cached and uncached lines returns every line in
+// order, consulting the wrapped cache only for the misses.
+func TestHotCacheLookupRangePartialHit(t *testing.T) {
+	inner := newFakeCache(100)
+	hc := newHotCache(inner, 1024*1024)
+
+	// Prime lines 10 and 12 (but not 11) in the hot cache.
+	if _, err := hc.Lookup(10); err != nil {
+		t.Fatalf("Lookup(10): %v", err)
+	}
+	if _, err := hc.Lookup(12); err != nil {
+		t.Fatalf("Lookup(12): %v", err)
+	}
+
+	lines, err := hc.LookupRange(10, 3)
+	if err != nil {
+		t.Fatalf("LookupRange(10, 3): %v", err)
+	}
+	want := []string{"line 10\n", "line 11\n", "line 12\n"}
+	for i, w := range want {
+		if lines[i] != w {
+			t.Fatalf("line %d: expected %q, got %q", 10+i, w, lines[i])
+		}
+	}
+}
+
+// TestHotCacheLookupRangeClipsAtEOF is a regression test: LookupRange
+// used to pad its result out to the requested count even when some of
+// the requested lines were past EOF, leaving trailing "" entries
+// instead of clipping the result the way lineOffsetCache.LookupRange
+// does. Combined with the server's read-ahead window, that turned a
+// GET past EOF into a silent empty response instead of an error.
+func TestHotCacheLookupRangeClipsAtEOF(t *testing.T) {
+	inner := newFakeCache(5)
+	hc := newHotCache(inner, 1024*1024)
+
+	lines, err := hc.LookupRange(5, 16)
+	if err != nil {
+		t.Fatalf("LookupRange(5, 16): %v", err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("expected LookupRange to clip to 1 line (only line 5 "+
+			"exists), got %d: %q", len(lines), lines)
+	}
+	if lines[0] != "line 5\n" {
+		t.Fatalf("unexpected line: %q", lines[0])
+	}
+
+	// A subsequent request entirely past EOF must still error, exactly
+	// as the wrapped cache would.
+	if _, err := hc.LookupRange(8, 16); err == nil {
+		t.Fatalf("expected an error for a range entirely past EOF")
+	}
+}
+
+// TestHotCacheEviction verifies that a shard evicts its least
+// recently used entries once its byte budget is exceeded.
+func TestHotCacheEviction(t *testing.T) {
+	inner := newFakeCache(10)
+	// A tiny byte budget that can only hold a couple of lines per
+	// shard once split across hotCacheShardCount.
+	hc := newHotCache(inner, hotCacheShardCount*16)
+
+	for i := int64(1); i <= 10; i++ {
+		if _, err := hc.Lookup(i); err != nil {
+			t.Fatalf("Lookup(%d): %v", i, err)
+		}
+	}
+
+	s := hc.shardFor(1)
+	s.mu.Lock()
+	byteUsed, byteLimit := s.byteUsed, s.byteLimit
+	s.mu.Unlock()
+	if byteUsed > byteLimit {
+		t.Fatalf("shard byteUsed %d exceeds byteLimit %d after eviction",
+			byteUsed, byteLimit)
+	}
+}
@@ -8,6 +8,19 @@
 // QUIT
 // SHUTDOWN
 //
+// If -auth_token_file is set, a connection must send "AUTH <token>"
+// before any command but QUIT is honored.
+//
+// A second, versioned tier of commands is negotiated with a HELLO
+// handshake and answered with a framed "OK <nbytes>\n<payload>" (or
+// "ERR <message>\n") response instead of GET's raw line, so
+// binary-safe and multi-line payloads can't collide with the
+// line-oriented protocol above:
+// HELLO <protocol version>
+// RANGE <start line> <end line>  (inclusive, payload terminated by ".")
+// COUNT
+// STATS
+//
 // Sample client usage:
 // $ echo "GET 7777" | nc localhost 8080
 // $ echo "SHUTDOWN" | nc localhost 8080
@@ -20,12 +33,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // The LineServer has a server implmentation, which in turn controls
@@ -42,8 +58,61 @@ var (
 		"the address the server will listen for requests on")
 	cacheSize = flag.Int("cache_size", 1024*1024,
 		"recommended number of items to retain in the cache")
+	readAheadLines = flag.Int64("readahead_lines", 16,
+		"number of lines to preload per connection on each GET, "+
+			"so a client issuing sequential GETs hits a local window "+
+			"instead of re-scanning the file")
+	hotCacheBytes = flag.Int64("hot_cache_bytes", 1024*1024,
+		"byte budget for the dynamic hot-line LRU cache layered in "+
+			"front of the static offset cache; 0 disables it")
+	shutdownGrace = flag.Duration("shutdown_grace", 5*time.Second,
+		"how long shutdown waits for in-flight connections to finish "+
+			"before force-closing them")
+	maxRangeLines = flag.Int64("max_range_lines", 65536,
+		"maximum number of lines a single RANGE command may request; "+
+			"caps how much of the file one connection can force the "+
+			"server to materialize in memory at once")
+	separator = flag.String("separator", "\\n",
+		"record separator: \\n (default), \\r, \\r\\n, \\t, or \\0 (NUL, "+
+			"e.g. to index find -print0 output); any other value is taken "+
+			"literally as the raw separator byte sequence, so e.g. a "+
+			"UTF-16 line ending can be passed as its literal encoded bytes")
+	tlsCert = flag.String("tls_cert", "",
+		"path to a TLS certificate; if set along with -tls_key, the "+
+			"server listens over TLS instead of plain TCP")
+	tlsKey = flag.String("tls_key", "",
+		"path to the private key for -tls_cert")
+	authTokenFile = flag.String("auth_token_file", "",
+		"path to a file holding the shared token clients must supply "+
+			"via AUTH before GET/SHUTDOWN/etc. are honored; empty disables "+
+			"authentication")
 )
 
+// parseSeparator interprets the -separator flag into the delimiter
+// byte sequence lineOffsetCache scans for.  It recognizes the escapes
+// "\n", "\r", "\r\n", "\t", and "\0"; anything else is taken literally
+// as a raw byte sequence, which is how multi-byte separators such as
+// a UTF-16 line ending (passed as its literal encoded bytes) are
+// supported.
+func parseSeparator(s string) ([]byte, error) {
+	switch s {
+	case "\\n":
+		return []byte{'\n'}, nil
+	case "\\r":
+		return []byte{'\r'}, nil
+	case "\\r\\n":
+		return []byte{'\r', '\n'}, nil
+	case "\\t":
+		return []byte{'\t'}, nil
+	case "\\0":
+		return []byte{0}, nil
+	}
+	if len(s) == 0 {
+		return nil, fmt.Errorf("invalid -separator %q: must not be empty", s)
+	}
+	return []byte(s), nil
+}
+
 func main() {
 	flag.Parse()
 	if flag.NArg() < 1 {
@@ -53,15 +122,60 @@ func main() {
 
 	ls := &lineServer{}
 
+	recordSep, err := parseSeparator(*separator)
+	if err != nil {
+		log.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
 	// Buuld the static cache first.
-	cache, err := newLineOffsetCache(flag.Arg(0), *cacheSize)
+	cache, err := newLineOffsetCache(flag.Arg(0), *cacheSize, recordSep)
 	if err != nil {
 		log.Printf("error creating cache: '%v'\n", err)
 		os.Exit(1)
 	}
 
+	// Layer the dynamic hot-line cache on top of the static offset
+	// cache, unless the operator disabled it.
+	var indexCache IndexCache = cache
+	if *hotCacheBytes > 0 {
+		indexCache = newHotCache(cache, *hotCacheBytes)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Printf("-tls_cert and -tls_key must both be set to enable TLS\n")
+			os.Exit(1)
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Printf("error loading TLS keypair: '%v'\n", err)
+			os.Exit(1)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	var authToken []byte
+	if *authTokenFile != "" {
+		data, err := os.ReadFile(*authTokenFile)
+		if err != nil {
+			log.Printf("error reading auth token file: '%v'\n", err)
+			os.Exit(1)
+		}
+		authToken = bytes.TrimSpace(data)
+		if len(authToken) == 0 {
+			log.Printf(
+				"-auth_token_file %q is empty or whitespace-only; refusing "+
+					"to start with authentication silently disabled\n",
+				*authTokenFile)
+			os.Exit(1)
+		}
+	}
+
 	// Build the TCP server, passing it the cache.
-	ls.server = newServer(*addr, cache)
+	ls.server = newServer(*addr, indexCache, *readAheadLines, *shutdownGrace,
+		*maxRangeLines, tlsConfig, authToken)
 
 	// Shutdown cleanup on termination signal (SIGINT and SIGTERM for now).
 	go func() {
@@ -80,5 +194,19 @@ func main() {
 		log.Printf("error processing requests: '%v'\n", err)
 		code = 1
 	}
+
+	// processRequests returning only means the accept loop stopped; it
+	// does not mean the drain of in-flight connections triggered by a
+	// signal or a SHUTDOWN command has finished (both of those run
+	// shutdown asynchronously with respect to us).  Call shutdown here
+	// too -- a no-op via isShutdown if one of those already won the
+	// race -- and wait for it to actually complete before tearing down
+	// the cache out from under any connection still draining.
+	ls.server.shutdown()
+	<-ls.server.Done()
+
+	if err := cache.Close(); err != nil {
+		log.Printf("warning: error closing cache: %v\n", err)
+	}
 	os.Exit(code)
 }
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server backed by cache on an ephemeral
+// localhost port and returns it along with its address. The caller is
+// responsible for shutting it down.
+func startTestServer(t *testing.T, cache IndexCache,
+	maxRangeLines int64) (*server, string) {
+	t.Helper()
+	s := newServer("localhost:0", cache, 0, 0, maxRangeLines, nil, nil)
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.processRequests() }()
+
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+	return s, fmt.Sprintf("localhost:%d", s.getPort())
+}
+
+// sendCommand dials addr, sends line, and returns everything the
+// server writes back before closing its half of the connection.
+func sendCommand(t *testing.T, addr, line string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("write command: %v", err)
+	}
+	conn.Write([]byte(quitCmd + "\n"))
+
+	var sb strings.Builder
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := r.Read(buf)
+		sb.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// parseFramedOK splits a framed "OK <nbytes>\n<payload>" response into
+// its declared length and payload, failing the test if malformed.
+func parseFramedOK(t *testing.T, resp string) (int, string) {
+	t.Helper()
+	const prefix = "OK "
+	if !strings.HasPrefix(resp, prefix) {
+		t.Fatalf("expected framed OK response, got %q", resp)
+	}
+	nl := strings.IndexByte(resp, '\n')
+	if nl < 0 {
+		t.Fatalf("malformed framed response, no header newline: %q", resp)
+	}
+	n, err := strconv.Atoi(resp[len(prefix):nl])
+	if err != nil {
+		t.Fatalf("malformed framed length in %q: %v", resp, err)
+	}
+	return n, resp[nl+1:]
+}
+
+func TestServerRangeCommand(t *testing.T) {
+	cache := newFakeCache(50)
+	s, addr := startTestServer(t, cache, 0)
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	resp := sendCommand(t, addr, "RANGE 3 5")
+	n, payload := parseFramedOK(t, resp)
+	if n != len(payload) {
+		t.Fatalf("declared length %d does not match payload length %d",
+			n, len(payload))
+	}
+	want := "line 3\nline 4\nline 5\n" + rangeTerminator
+	if payload != want {
+		t.Fatalf("RANGE 3 5: got %q, want %q", payload, want)
+	}
+}
+
+func TestServerRangeCommandSpanLimit(t *testing.T) {
+	cache := newFakeCache(1000)
+	s, addr := startTestServer(t, cache, 10)
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	resp := sendCommand(t, addr, "RANGE 1 500")
+	if !strings.HasPrefix(resp, "ERR ") {
+		t.Fatalf("expected a RANGE exceeding the configured span limit to "+
+			"be rejected, got %q", resp)
+	}
+
+	// A span within the limit should still succeed.
+	resp = sendCommand(t, addr, "RANGE 1 10")
+	if !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("expected an in-bounds RANGE to succeed, got %q", resp)
+	}
+}
+
+func TestServerCountAndStats(t *testing.T) {
+	cache := newFakeCache(123)
+	s, addr := startTestServer(t, cache, 0)
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	resp := sendCommand(t, addr, countCmd)
+	_, payload := parseFramedOK(t, resp)
+	if strings.TrimSpace(payload) != "123" {
+		t.Fatalf("COUNT: got %q, want \"123\"", strings.TrimSpace(payload))
+	}
+
+	resp = sendCommand(t, addr, statsCmd)
+	_, payload = parseFramedOK(t, resp)
+	if !strings.Contains(payload, "cache_size=") ||
+		!strings.Contains(payload, "hot_cache_hit_rate=") {
+		t.Fatalf("STATS: unexpected payload %q", payload)
+	}
+}
+
+// TestServerShutdownDrainsIdleConnection verifies that shutdown
+// unblocks a connection parked in a blocking read (via the
+// SetDeadline call on each tracked conn) well within the configured
+// grace period, rather than waiting it out or hanging.
+func TestServerShutdownDrainsIdleConnection(t *testing.T) {
+	cache := newFakeCache(10)
+	s := newServer("localhost:0", cache, 0, 2*time.Second, 0, nil, nil)
+	go s.processRequests()
+
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", s.getPort()))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Give handleConnection a moment to start blocking on its read
+	// before triggering shutdown, so the drain has to actually unblock
+	// it rather than simply racing an as-yet-untracked connection.
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	go s.shutdown()
+	select {
+	case <-s.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("shutdown did not drain the idle connection within its own grace period")
+	}
+	if elapsed := time.Since(start); elapsed >= s.shutdownGrace {
+		t.Fatalf("shutdown took %v, at or beyond the %v grace period; "+
+			"the idle connection's read was not unblocked via SetDeadline",
+			elapsed, s.shutdownGrace)
+	}
+}
+
+// sendRawCommands dials addr, writes each of lines in order (each
+// followed by a newline), and returns everything the server writes
+// back before closing its half of the connection. Unlike sendCommand
+// it does not append QUIT, so callers can observe a connection the
+// server closes on its own (e.g. after an AUTH failure).
+func sendRawCommands(t *testing.T, addr string, lines ...string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	for _, line := range lines {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatalf("write command %q: %v", line, err)
+		}
+	}
+
+	var sb strings.Builder
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := r.Read(buf)
+		sb.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	return sb.String()
+}
+
+func TestServerAuthRequiredForCommands(t *testing.T) {
+	cache := newFakeCache(10)
+	s := newServer("localhost:0", cache, 0, 0, 0, nil, []byte("s3cr3t"))
+	go s.processRequests()
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+	addr := fmt.Sprintf("localhost:%d", s.getPort())
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	resp := sendRawCommands(t, addr, "GET 1")
+	if !strings.Contains(resp, "authentication required") {
+		t.Fatalf("expected an unauthenticated GET to be rejected, got %q", resp)
+	}
+
+	resp = sendRawCommands(t, addr, shutdownCmd)
+	if !strings.Contains(resp, "authentication required") {
+		t.Fatalf("expected an unauthenticated SHUTDOWN to be rejected, got %q",
+			resp)
+	}
+	select {
+	case <-s.Done():
+		t.Fatalf("an unauthenticated SHUTDOWN must not be honored")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServerAuthUnlocksCommands(t *testing.T) {
+	cache := newFakeCache(10)
+	s := newServer("localhost:0", cache, 0, 0, 0, nil, []byte("s3cr3t"))
+	go s.processRequests()
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+	addr := fmt.Sprintf("localhost:%d", s.getPort())
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	resp := sendRawCommands(t, addr, "AUTH s3cr3t", "GET 1", quitCmd)
+	if !strings.HasPrefix(resp, "OK 0\n") {
+		t.Fatalf("expected AUTH to succeed, got %q", resp)
+	}
+	if !strings.Contains(resp, "line 1\n") {
+		t.Fatalf("expected the authenticated GET to succeed, got %q", resp)
+	}
+}
+
+func TestServerAuthWrongTokenCloses(t *testing.T) {
+	cache := newFakeCache(10)
+	s := newServer("localhost:0", cache, 0, 0, 0, nil, []byte("s3cr3t"))
+	go s.processRequests()
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+	addr := fmt.Sprintf("localhost:%d", s.getPort())
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	start := time.Now()
+	resp := sendRawCommands(t, addr, "AUTH wrong-token", "GET 1")
+	elapsed := time.Since(start)
+
+	if !strings.Contains(resp, "authentication failed") {
+		t.Fatalf("expected a wrong AUTH token to be rejected, got %q", resp)
+	}
+	if strings.Contains(resp, "line 1\n") {
+		t.Fatalf("a command following a failed AUTH must not be honored, got %q",
+			resp)
+	}
+	if elapsed < authFailureDelay {
+		t.Fatalf("connection closed after %v, before authFailureDelay (%v) "+
+			"elapsed", elapsed, authFailureDelay)
+	}
+}
+
+// generateSelfSignedCert returns an in-memory self-signed TLS
+// certificate valid for "localhost", for use by TestServerTLS.
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("build keypair: %v", err)
+	}
+	return cert
+}
+
+func TestServerTLS(t *testing.T) {
+	cert := generateSelfSignedCert(t)
+	cache := newFakeCache(10)
+	s := newServer("localhost:0", cache, 0, 0, 0,
+		&tls.Config{Certificates: []tls.Certificate{cert}}, nil)
+	go s.processRequests()
+	select {
+	case <-s.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("server never started listening")
+	}
+	addr := fmt.Sprintf("localhost:%d", s.getPort())
+	defer func() {
+		go s.shutdown()
+		<-s.Done()
+	}()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls dial: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("GET 1\n")); err != nil {
+		t.Fatalf("write GET over TLS: %v", err)
+	}
+	conn.Write([]byte(quitCmd + "\n"))
+
+	var sb strings.Builder
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		sb.Write(buf[:n])
+		if err != nil {
+			break
+		}
+	}
+	if sb.String() != "line 1\n" {
+		t.Fatalf("GET over TLS: got %q, want %q", sb.String(), "line 1\n")
+	}
+}
+
+// TestServerShutdownCommandDoesNotDeadlock is a regression test: the
+// SHUTDOWN command used to call shutdown synchronously from within the
+// very connection goroutine shutdown's wg.Wait() was waiting on,
+// deadlocking forever.
+func TestServerShutdownCommandDoesNotDeadlock(t *testing.T) {
+	cache := newFakeCache(10)
+	s, addr := startTestServer(t, cache, 0)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(shutdownCmd + "\n")); err != nil {
+		t.Fatalf("write SHUTDOWN: %v", err)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown triggered via the SHUTDOWN command never completed")
+	}
+}